@@ -0,0 +1,292 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partition
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// SgdiskCmd is the sgdisk executable to invoke for GPT-table entries. Exposed so tests can
+// stub it.
+var SgdiskCmd = gptBackend{}.ExecutablePath()
+
+// PartedCmd is the parted executable to invoke for DOS-table entries. Exposed so tests can
+// stub it.
+var PartedCmd = dosBackend{}.ExecutablePath()
+
+// PartxCmd is the partx executable to invoke. Exposed so tests can stub it.
+var PartxCmd = "partx"
+
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// sysClassBlockPath is the root of the sysfs block device tree, read by holdersFor,
+// childPartitions, and disposition.go's ProbeExistingPartitions. Exposed so tests can point it
+// at a fixture directory instead of the real /sys.
+var sysClassBlockPath = "/sys/class/block"
+
+// procMountsPath and procSwapsPath are read by mountedNodes. Exposed so tests can point them at
+// fixture files instead of the real /proc.
+var procMountsPath = "/proc/mounts"
+var procSwapsPath = "/proc/swaps"
+
+// ApplyOptions controls how a scheme entry is applied to its underlying device(s).
+type ApplyOptions struct {
+	// Force, when set, allows an in-use device or partition to be destroyed anyway.
+	Force bool
+}
+
+// InUseError is returned when Apply refuses to touch a device because it (or one of its
+// existing partitions) is currently mounted, active swap, or held open by another device
+// (e.g. dm-crypt, LVM, or a software raid member).
+type InUseError struct {
+	Device  string
+	Holders map[string][]string
+}
+
+func (e *InUseError) Error() string {
+	offenders := make([]string, 0, len(e.Holders))
+	for node, holders := range e.Holders {
+		offenders = append(offenders, fmt.Sprintf("%s (held by: %s)", node, strings.Join(holders, ", ")))
+	}
+	return fmt.Sprintf("refusing to repartition %s, in use: %s", e.Device, strings.Join(offenders, "; "))
+}
+
+// Apply runs the partition table backend (sgdisk, or parted for e.TableType == "dos") with
+// the partition args for this entry against the given device, after first classifying e's
+// partitions against whatever already exists on device (so a re-apply preserves rather than
+// destroys a partition it finds there) and verifying that the device and its existing
+// partitions are not currently held or mounted. Pass opts.Force to proceed anyway.
+func (e *PerfSchemeEntry) Apply(device string, opts ApplyOptions) error {
+	existing, err := ProbeExistingPartitions(device)
+	if err != nil {
+		return err
+	}
+	ClassifyEntry(e, existing)
+
+	return applyPartitionArgs(device, execCmdFor(e.TableType), e.GetPartitionArgs(), opts)
+}
+
+// Apply runs the partition table backend (sgdisk, or parted for m.TableType == "dos") with
+// the partition args for this metadata device, after first classifying m's partitions against
+// whatever already exists on device (so a re-apply preserves rather than destroys a partition
+// it finds there) and verifying that the device and its existing partitions are not currently
+// held or mounted. Pass opts.Force to proceed anyway.
+func (m *MetadataDeviceInfo) Apply(device string, opts ApplyOptions) error {
+	existing, err := ProbeExistingPartitions(device)
+	if err != nil {
+		return err
+	}
+	ClassifyMetadata(m, existing)
+
+	return applyPartitionArgs(device, execCmdFor(m.TableType), m.GetPartitionArgs(), opts)
+}
+
+// execCmdFor resolves the command line tool to invoke for a given TableType, honoring the
+// SgdiskCmd/PartedCmd overrides that tests stub out.
+func execCmdFor(tableType string) string {
+	if tableType == "dos" {
+		return PartedCmd
+	}
+	return SgdiskCmd
+}
+
+func applyPartitionArgs(device, execCmd string, args []string, opts ApplyOptions) error {
+	holders, err := checkDeviceInUse(device)
+	if err != nil {
+		return err
+	}
+
+	return refuseOrApply(device, execCmd, args, holders, opts)
+}
+
+// refuseOrApply is the in-use decision point, split out from applyPartitionArgs so tests
+// can exercise it with a synthetic holders map instead of real /sys and /proc state.
+func refuseOrApply(device, execCmd string, args []string, holders map[string][]string, opts ApplyOptions) error {
+	if len(holders) > 0 && !opts.Force {
+		return &InUseError{Device: device, Holders: holders}
+	}
+
+	if _, err := runCommand(execCmd, args...); err != nil {
+		return fmt.Errorf("failed to run %s on /dev/%s: %+v", execCmd, device, err)
+	}
+
+	if len(holders) > 0 {
+		// the disk or its partitions were in use (mounted, active swap, or held open), so
+		// BLKRRPART (triggered internally by sgdisk or parted) will have failed to make the
+		// kernel pick up the new table. partx can refresh it even while the old partitions
+		// are still in use.
+		if _, err := runCommand(PartxCmd, "--update", fmt.Sprintf("/dev/%s", device)); err != nil {
+			return fmt.Errorf("failed to refresh partition table on /dev/%s with %s: %+v", device, PartxCmd, err)
+		}
+	}
+
+	return nil
+}
+
+// checkDeviceInUse looks at the given disk and each of its existing partitions and returns
+// a map of offending block device node to the reasons it is considered in use (open holders,
+// an active mount, or active swap). An empty, nil-error result means the disk is safe to
+// repartition.
+func checkDeviceInUse(device string) (map[string][]string, error) {
+	holders := map[string][]string{}
+
+	mounted, err := mountedNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []string{device}
+	children, err := childPartitions(device)
+	if err != nil {
+		return nil, err
+	}
+	nodes = append(nodes, children...)
+
+	for _, node := range nodes {
+		reasons := []string{}
+
+		nodeHolders, err := holdersFor(node)
+		if err != nil {
+			return nil, err
+		}
+		reasons = append(reasons, nodeHolders...)
+
+		if reason, ok := mounted[node]; ok {
+			reasons = append(reasons, reason)
+		}
+
+		if len(reasons) > 0 {
+			holders[node] = reasons
+		}
+	}
+
+	return holders, nil
+}
+
+// holdersFor returns the names of any devices that are holding the given block device node
+// open (e.g. because it is a dm-crypt or LVM member), by reading /sys/class/block/<node>/holders.
+func holdersFor(node string) ([]string, error) {
+	path := filepath.Join(sysClassBlockPath, node, "holders")
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %+v", path, err)
+	}
+
+	holders := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		holders = append(holders, entry.Name())
+	}
+	return holders, nil
+}
+
+// childPartitions walks /sys/class/block/<disk> and returns the block device node names of
+// every partition of the given disk.
+func childPartitions(device string) ([]string, error) {
+	path := filepath.Join(sysClassBlockPath, device)
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %+v", path, err)
+	}
+
+	children := []string{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), device) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(path, entry.Name(), "partition")); err != nil {
+			continue
+		}
+		children = append(children, entry.Name())
+	}
+	return children, nil
+}
+
+// mountedNodes returns a map of block device node name (e.g. "sda1") to a human readable
+// reason it is considered active, built from /proc/mounts and /proc/swaps.
+func mountedNodes() (map[string]string, error) {
+	mounted := map[string]string{}
+
+	if err := scanProcTable(procMountsPath, func(fields []string) {
+		node := nodeFromDevPath(fields[0])
+		if node == "" {
+			return
+		}
+		mounted[node] = fmt.Sprintf("mounted at %s", fields[1])
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := scanProcTable(procSwapsPath, func(fields []string) {
+		node := nodeFromDevPath(fields[0])
+		if node == "" {
+			return
+		}
+		mounted[node] = "active swap"
+	}); err != nil {
+		return nil, err
+	}
+
+	return mounted, nil
+}
+
+func scanProcTable(path string, handle func(fields []string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open %s: %+v", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	first := true
+	for scanner.Scan() {
+		if first {
+			// /proc/swaps has a header line, /proc/mounts does not; a line that doesn't
+			// start with a /dev path is harmless to skip either way.
+			first = false
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		handle(fields)
+	}
+	return scanner.Err()
+}
+
+func nodeFromDevPath(devPath string) string {
+	if !strings.HasPrefix(devPath, "/dev/") {
+		return ""
+	}
+	return strings.TrimPrefix(devPath, "/dev/")
+}
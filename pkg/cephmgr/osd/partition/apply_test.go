@@ -0,0 +1,206 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partition
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplySucceedsWhenDeviceNotInUse(t *testing.T) {
+	defer resetRunCommand()
+	defer resetSysProcPaths()
+
+	root, err := ioutil.TempDir("", "TestApplySucceedsWhenDeviceNotInUse")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	sysClassBlockPath = root
+	procMountsPath = filepath.Join(root, "mounts")
+	procSwapsPath = filepath.Join(root, "swaps")
+
+	var ran [][]string
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		ran = append(ran, append([]string{name}, args...))
+		return nil, nil
+	}
+
+	entry := NewPerfSchemeEntry()
+	entry.ID = 1
+	entry.Partitions[BlockPartitionName] = &PerfSchemePartitionDetails{Device: "doesnotexist0", SizeMB: -1, OffsetMB: 1}
+
+	err = entry.Apply("doesnotexist0", ApplyOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ran))
+	assert.Equal(t, SgdiskCmd, ran[0][0])
+}
+
+func TestApplyRefusesInUseDeviceWithoutForce(t *testing.T) {
+	defer resetRunCommand()
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		t.Fatalf("should not have run %s %v, device is in use", name, args)
+		return nil, nil
+	}
+
+	// simulate a held device by faking out the in-use check directly, since /sys and
+	// /proc are not under test control in a unit test environment.
+	holders := map[string][]string{"sdz": {"dm-0"}}
+	err := refuseOrApply("sdz", SgdiskCmd, []string{"--new=1:0:+0"}, holders, ApplyOptions{Force: false})
+	assert.NotNil(t, err)
+	_, ok := err.(*InUseError)
+	assert.True(t, ok)
+}
+
+func TestApplyForceRefreshesPartitionTableWithPartx(t *testing.T) {
+	defer resetRunCommand()
+
+	var ran [][]string
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		ran = append(ran, append([]string{name}, args...))
+		return nil, nil
+	}
+
+	holders := map[string][]string{"sdz1": {"mounted at /var/lib/rook"}}
+	err := refuseOrApply("sdz", SgdiskCmd, []string{"--new=1:0:+0"}, holders, ApplyOptions{Force: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ran))
+	assert.Equal(t, SgdiskCmd, ran[0][0])
+	assert.Equal(t, PartxCmd, ran[1][0])
+}
+
+func TestApplyPreservesExistingPartitionsOnReapply(t *testing.T) {
+	defer resetRunCommand()
+	defer resetSysProcPaths()
+
+	e := NewPerfSchemeEntry()
+	e.ID = 1
+	bluestoreConfig := BluestoreConfig{WalSizeMB: 1, DatabaseSizeMB: 2}
+	assert.Nil(t, PopulateCollocatedPerfSchemeEntry(e, "sdb", bluestoreConfig))
+
+	root, err := ioutil.TempDir("", "TestApplyPreservesExistingPartitionsOnReapply")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	sysClassBlockPath = root
+	procMountsPath = filepath.Join(root, "mounts")
+	assert.Nil(t, ioutil.WriteFile(procMountsPath, []byte(""), 0644))
+	procSwapsPath = filepath.Join(root, "swaps")
+	assert.Nil(t, ioutil.WriteFile(procSwapsPath, []byte(""), 0644))
+
+	writePartitionFixture(t, root, "sdb", 1, e.Partitions[WalPartitionName].PartitionUUID)
+	writePartitionFixture(t, root, "sdb", 2, e.Partitions[DatabasePartitionName].PartitionUUID)
+	writePartitionFixture(t, root, "sdb", 3, e.Partitions[BlockPartitionName].PartitionUUID)
+
+	var ran [][]string
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		ran = append(ran, append([]string{name}, args...))
+		return nil, nil
+	}
+
+	err = e.Apply("sdb", ApplyOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ran))
+	assert.Equal(t, []string{
+		SgdiskCmd, "--info=1", "--info=2", "--info=3",
+		fmt.Sprintf("--disk-guid=%s", e.Partitions[BlockPartitionName].DiskUUID), "/dev/sdb",
+	}, ran[0])
+}
+
+// writePartitionFixture creates the /sys/class/block/<device>/<device><number> tree that
+// ProbeExistingPartitions reads, recording partUUID as the child's PARTUUID.
+func writePartitionFixture(t *testing.T, root, device string, number int, partUUID string) {
+	dir := filepath.Join(root, device, fmt.Sprintf("%s%d", device, number))
+	assert.Nil(t, os.MkdirAll(dir, 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "partition"), []byte(fmt.Sprintf("%d", number)), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "uevent"), []byte(fmt.Sprintf("PARTUUID=%s\n", partUUID)), 0644))
+}
+
+func TestCheckDeviceInUseFindsHolderOfChildPartition(t *testing.T) {
+	defer resetSysProcPaths()
+
+	root, err := ioutil.TempDir("", "TestCheckDeviceInUseFindsHolderOfChildPartition")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	sysClassBlockPath = root
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "sdz", "sdz1"), 0755))
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "sdz1", "holders", "dm-0"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "sdz", "sdz1", "partition"), []byte("1"), 0644))
+
+	procMountsPath = filepath.Join(root, "mounts")
+	assert.Nil(t, ioutil.WriteFile(procMountsPath, []byte(""), 0644))
+	procSwapsPath = filepath.Join(root, "swaps")
+	assert.Nil(t, ioutil.WriteFile(procSwapsPath, []byte(""), 0644))
+
+	holders, err := checkDeviceInUse("sdz")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dm-0"}, holders["sdz1"])
+}
+
+func TestCheckDeviceInUseFindsMountedChildPartition(t *testing.T) {
+	defer resetSysProcPaths()
+
+	root, err := ioutil.TempDir("", "TestCheckDeviceInUseFindsMountedChildPartition")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	sysClassBlockPath = root
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "sdz", "sdz1"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "sdz", "sdz1", "partition"), []byte("1"), 0644))
+
+	procMountsPath = filepath.Join(root, "mounts")
+	assert.Nil(t, ioutil.WriteFile(procMountsPath, []byte("/dev/sdz1 /var/lib/rook ext4 rw 0 0\n"), 0644))
+	procSwapsPath = filepath.Join(root, "swaps")
+	assert.Nil(t, ioutil.WriteFile(procSwapsPath, []byte(""), 0644))
+
+	holders, err := checkDeviceInUse("sdz")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mounted at /var/lib/rook"}, holders["sdz1"])
+}
+
+func TestCheckDeviceInUseEmptyWhenNothingInUse(t *testing.T) {
+	defer resetSysProcPaths()
+
+	root, err := ioutil.TempDir("", "TestCheckDeviceInUseEmptyWhenNothingInUse")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	sysClassBlockPath = root
+	procMountsPath = filepath.Join(root, "mounts")
+	assert.Nil(t, ioutil.WriteFile(procMountsPath, []byte(""), 0644))
+	procSwapsPath = filepath.Join(root, "swaps")
+	assert.Nil(t, ioutil.WriteFile(procSwapsPath, []byte(""), 0644))
+
+	holders, err := checkDeviceInUse("doesnotexist0")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(holders))
+}
+
+func resetRunCommand() {
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		return nil, nil
+	}
+}
+
+func resetSysProcPaths() {
+	sysClassBlockPath = "/sys/class/block"
+	procMountsPath = "/proc/mounts"
+	procSwapsPath = "/proc/swaps"
+}
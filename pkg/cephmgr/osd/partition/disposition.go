@@ -0,0 +1,135 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partition
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ProbeExistingPartitions inspects the child partitions already present on device and returns
+// a map of (lowercased) PARTUUID to the partition number it currently occupies. It is used to
+// tell ClassifyEntry/ClassifyMetadata which of a scheme's desired partitions already exist so
+// a re-applied scheme doesn't destroy them.
+func ProbeExistingPartitions(device string) (map[string]int, error) {
+	found := map[string]int{}
+
+	path := filepath.Join(sysClassBlockPath, device)
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return found, nil
+		}
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), device) {
+			continue
+		}
+
+		numBytes, err := ioutil.ReadFile(filepath.Join(path, entry.Name(), "partition"))
+		if err != nil {
+			// not a partition node
+			continue
+		}
+		num, err := strconv.Atoi(strings.TrimSpace(string(numBytes)))
+		if err != nil {
+			continue
+		}
+
+		partUUID, err := readUeventField(filepath.Join(path, entry.Name(), "uevent"), "PARTUUID")
+		if err != nil || partUUID == "" {
+			continue
+		}
+
+		found[strings.ToLower(partUUID)] = num
+	}
+
+	return found, nil
+}
+
+func readUeventField(path, key string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer file.Close()
+
+	prefix := key + "="
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// ClassifyEntry sets each of entry's partitions' Disposition by comparing its PartitionUUID
+// against existing (as returned by ProbeExistingPartitions). A partition the caller already
+// marked DispositionSkip is left as it is, found or not. Otherwise a PartitionUUID found on
+// disk is marked DispositionPreserve with its current ExistingNumber, and a partition not
+// found that has no Disposition yet is set to DispositionForce.
+func ClassifyEntry(entry *PerfSchemeEntry, existing map[string]int) {
+	for _, p := range entry.Partitions {
+		classifyPartition(p, existing)
+	}
+}
+
+// ClassifyMetadata is ClassifyEntry's counterpart for a shared metadata device's partitions.
+func ClassifyMetadata(metadata *MetadataDeviceInfo, existing map[string]int) {
+	for _, p := range metadata.Partitions {
+		classifyMetadataPartition(p, existing)
+	}
+}
+
+func classifyPartition(p *PerfSchemePartitionDetails, existing map[string]int) {
+	if p.Disposition == DispositionSkip {
+		return
+	}
+	if num, ok := existing[strings.ToLower(p.PartitionUUID)]; ok {
+		p.Disposition = DispositionPreserve
+		p.ExistingNumber = num
+		return
+	}
+	if p.Disposition == "" {
+		p.Disposition = DispositionForce
+	}
+}
+
+func classifyMetadataPartition(p *MetadataDevicePartition, existing map[string]int) {
+	if p.Disposition == DispositionSkip {
+		return
+	}
+	if num, ok := existing[strings.ToLower(p.PartitionUUID)]; ok {
+		p.Disposition = DispositionPreserve
+		p.ExistingNumber = num
+		return
+	}
+	if p.Disposition == "" {
+		p.Disposition = DispositionForce
+	}
+}
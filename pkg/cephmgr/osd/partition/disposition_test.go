@@ -0,0 +1,98 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partition
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyEntryPreservesExistingPartitions(t *testing.T) {
+	e1 := NewPerfSchemeEntry()
+	e1.ID = 1
+	e1.OsdUUID = uuid.Must(uuid.NewRandom())
+
+	bluestoreConfig := BluestoreConfig{WalSizeMB: 1, DatabaseSizeMB: 2}
+	err := PopulateCollocatedPerfSchemeEntry(e1, "sdb", bluestoreConfig)
+	assert.Nil(t, err)
+
+	existing := map[string]int{
+		e1.Partitions[WalPartitionName].PartitionUUID:      1,
+		e1.Partitions[DatabasePartitionName].PartitionUUID: 2,
+	}
+	ClassifyEntry(e1, existing)
+
+	assert.Equal(t, DispositionPreserve, e1.Partitions[WalPartitionName].Disposition)
+	assert.Equal(t, 1, e1.Partitions[WalPartitionName].ExistingNumber)
+	assert.Equal(t, DispositionPreserve, e1.Partitions[DatabasePartitionName].Disposition)
+	assert.Equal(t, 2, e1.Partitions[DatabasePartitionName].ExistingNumber)
+	assert.Equal(t, DispositionForce, e1.Partitions[BlockPartitionName].Disposition)
+}
+
+func TestGetPartitionArgsPreservesAndExpandsBlockPartition(t *testing.T) {
+	e1 := NewPerfSchemeEntry()
+	e1.ID = 1
+	e1.OsdUUID = uuid.Must(uuid.NewRandom())
+
+	bluestoreConfig := BluestoreConfig{WalSizeMB: 1, DatabaseSizeMB: 2}
+	err := PopulateCollocatedPerfSchemeEntry(e1, "sdb", bluestoreConfig)
+	assert.Nil(t, err)
+
+	existing := map[string]int{
+		e1.Partitions[WalPartitionName].PartitionUUID:      1,
+		e1.Partitions[DatabasePartitionName].PartitionUUID: 2,
+		e1.Partitions[BlockPartitionName].PartitionUUID:    3,
+	}
+	ClassifyEntry(e1, existing)
+	e1.Partitions[BlockPartitionName].Expand = true
+
+	expectedArgs := []string{
+		"--info=1",
+		"--info=2",
+		"--delete=3", "--largest-new=3", "--change-name=3:ROOK-OSD1-BLOCK",
+		fmt.Sprintf("--partition-guid=3:%s", e1.Partitions[BlockPartitionName].PartitionUUID),
+		fmt.Sprintf("--disk-guid=%s", e1.Partitions[BlockPartitionName].DiskUUID), "/dev/sdb",
+	}
+
+	args := e1.GetPartitionArgs()
+	assert.Equal(t, expectedArgs, args)
+}
+
+func TestGetPartitionArgsSkipsUntouchedPartitions(t *testing.T) {
+	e1 := NewPerfSchemeEntry()
+	e1.ID = 1
+	e1.OsdUUID = uuid.Must(uuid.NewRandom())
+
+	bluestoreConfig := BluestoreConfig{WalSizeMB: 1, DatabaseSizeMB: 2}
+	err := PopulateCollocatedPerfSchemeEntry(e1, "sdb", bluestoreConfig)
+	assert.Nil(t, err)
+	e1.Partitions[WalPartitionName].Disposition = DispositionSkip
+
+	expectedArgs := []string{
+		"--new=2:4096:+4096", "--change-name=2:ROOK-OSD1-DB",
+		fmt.Sprintf("--partition-guid=2:%s", e1.Partitions[DatabasePartitionName].PartitionUUID),
+		"--largest-new=3", "--change-name=3:ROOK-OSD1-BLOCK",
+		fmt.Sprintf("--partition-guid=3:%s", e1.Partitions[BlockPartitionName].PartitionUUID),
+		fmt.Sprintf("--disk-guid=%s", e1.Partitions[BlockPartitionName].DiskUUID), "/dev/sdb",
+	}
+
+	args := e1.GetPartitionArgs()
+	assert.Equal(t, expectedArgs, args)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package luks formats and opens the LUKS2-encrypted partitions described by the partition
+// package's EncryptionConfig, handing the Ceph OSD a /dev/mapper device to consume in place
+// of the raw partition.
+package luks
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/rook/rook/pkg/cephmgr/osd/partition"
+)
+
+// CryptsetupCmd is the cryptsetup executable to invoke. Exposed so tests can stub it.
+var CryptsetupCmd = "cryptsetup"
+
+// BlkidCmd is the blkid executable to invoke. Exposed so tests can stub it.
+var BlkidCmd = "blkid"
+
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// mapperPrefix is prepended to the OSD ID to name the /dev/mapper device created for an
+// encrypted OSD's block partition.
+const mapperPrefix = "rook-osd-"
+
+// MapperPath returns the /dev/mapper path that an opened, encrypted OSD block device will
+// be available at.
+func MapperPath(osdID int) string {
+	return fmt.Sprintf("/dev/mapper/%s%d", mapperPrefix, osdID)
+}
+
+// devicePath returns device as an absolute path: a bare node name such as "sdb3" is prefixed
+// with "/dev/", while an absolute path (e.g. a /dev/disk/by-partuuid link) is used as is.
+func devicePath(device string) string {
+	if strings.HasPrefix(device, "/") {
+		return device
+	}
+	return fmt.Sprintf("/dev/%s", device)
+}
+
+// Format creates a new LUKS2 container on the given partition device (a node name such as
+// "sdb3", or an absolute path) using the supplied config and a stable header UUID, keyed with
+// the key at keyFile. It does not open the container; see Open.
+func Format(device string, luksUUID string, config partition.EncryptionConfig, keyFile string) error {
+	if config.Type != "luks2" {
+		return fmt.Errorf("unsupported encryption type %q, only luks2 is supported", config.Type)
+	}
+	if config.KeySource != "file" {
+		return fmt.Errorf("key source %q is not yet implemented", config.KeySource)
+	}
+
+	args := []string{
+		"luksFormat",
+		"--type", "luks2",
+		"--cipher", config.Cipher,
+		"--key-size", fmt.Sprintf("%d", config.KeySize),
+		"--pbkdf", config.PBKDF,
+		"--uuid", luksUUID,
+		"--batch-mode",
+		"--key-file", keyFile,
+		devicePath(device),
+	}
+	if _, err := runCommand(CryptsetupCmd, args...); err != nil {
+		return fmt.Errorf("failed to luksFormat %s: %+v", devicePath(device), err)
+	}
+
+	return nil
+}
+
+// Open unlocks the encrypted partition (a node name such as "sdb3", or an absolute path) and
+// maps it to /dev/mapper/rook-osd-<osdID>, returning that mapper path for the Ceph OSD to use
+// as its block device.
+func Open(device string, osdID int, keyFile string) (string, error) {
+	mapperName := fmt.Sprintf("%s%d", mapperPrefix, osdID)
+	args := []string{"luksOpen", devicePath(device), mapperName, "--key-file", keyFile}
+	if _, err := runCommand(CryptsetupCmd, args...); err != nil {
+		return "", fmt.Errorf("failed to luksOpen %s: %+v", devicePath(device), err)
+	}
+
+	return MapperPath(osdID), nil
+}
+
+// ResolveByUUID finds the current block device node backing a LUKS2 header UUID. This is
+// needed on discovery/reboot because the LUKS header UUID is independent of (and differs
+// from) the GPT PartitionUUID assigned when the partition was created.
+func ResolveByUUID(luksUUID string) (string, error) {
+	output, err := runCommand(BlkidCmd, "--uuid", luksUUID)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve device for LUKS UUID %s: %+v", luksUUID, err)
+	}
+
+	device := strings.TrimSpace(string(output))
+	if device == "" {
+		return "", fmt.Errorf("no device found for LUKS UUID %s", luksUUID)
+	}
+
+	return device, nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package luks
+
+import (
+	"testing"
+
+	"github.com/rook/rook/pkg/cephmgr/osd/partition"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatRejectsUnsupportedKeySource(t *testing.T) {
+	defer resetRunCommand()
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		t.Fatalf("should not have run %s %v", name, args)
+		return nil, nil
+	}
+
+	err := Format("sdb3", "some-uuid", partition.EncryptionConfig{Type: "luks2", KeySource: "tpm2"}, "/keys/osd1")
+	assert.NotNil(t, err)
+}
+
+func TestFormatInvokesCryptsetupLuksFormat(t *testing.T) {
+	defer resetRunCommand()
+	var ran []string
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		ran = append(append([]string{name}, args...))
+		return nil, nil
+	}
+
+	config := partition.EncryptionConfig{Type: "luks2", KeySize: 512, PBKDF: "argon2id", Cipher: "aes-xts-plain64", KeySource: "file"}
+	err := Format("sdb3", "some-uuid", config, "/keys/osd1")
+	assert.Nil(t, err)
+	assert.Equal(t, CryptsetupCmd, ran[0])
+}
+
+func TestMapperPath(t *testing.T) {
+	assert.Equal(t, "/dev/mapper/rook-osd-7", MapperPath(7))
+}
+
+func resetRunCommand() {
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		return nil, nil
+	}
+}
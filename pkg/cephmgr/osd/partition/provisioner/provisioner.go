@@ -0,0 +1,345 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package provisioner drives the partitions described by a saved partition.Scheme through a
+// small set of idempotent phases until every OSD is ready for Ceph to use, resuming from
+// wherever a previous run left off rather than starting over.
+package provisioner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/rook/rook/pkg/cephmgr/osd/partition"
+	"github.com/rook/rook/pkg/cephmgr/osd/partition/luks"
+)
+
+var logger = capnslog.NewPackageLogger("github.com/rook/rook", "provisioner")
+
+// MountCmd is the mount executable to invoke when mounting an OSD's tmpfs data directory.
+// Exposed so tests can stub it.
+var MountCmd = "mount"
+
+// MkdirCmd is the mkdir executable used to create an OSD's data directory before mounting it.
+// Exposed so tests can stub it.
+var MkdirCmd = "mkdir"
+
+// LnCmd is the ln executable used to link an OSD's block device into its data directory.
+// Exposed so tests can stub it.
+var LnCmd = "ln"
+
+// CephOsdCmd is the ceph-osd executable used to prepare (format) an OSD's store. Exposed so
+// tests can stub it.
+var CephOsdCmd = "ceph-osd"
+
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// luksFormat, luksOpen and luksResolveByUUID delegate to the sibling luks package. Exposed as
+// package vars, like runCommand, so tests can stub the LUKS2 steps without invoking cryptsetup
+// or blkid for real.
+var luksFormat = luks.Format
+var luksOpen = luks.Open
+var luksResolveByUUID = luks.ResolveByUUID
+
+// procMountsPath is read by isMountPoint. Exposed so tests can point it at a fixture file
+// instead of the real /proc/mounts.
+var procMountsPath = "/proc/mounts"
+
+// isMountPoint reports whether target is currently mounted, by scanning /proc/mounts. A package
+// var, like statPath, so tests can simulate a reboot (where nothing is mounted any more) without
+// a live kernel.
+var isMountPoint = isMountPointFromProcMounts
+
+func isMountPointFromProcMounts(target string) (bool, error) {
+	file, err := os.Open(procMountsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[1] == target {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// phaseOrder is the sequence every entry progresses through. A single Reconcile call runs
+// every step an entry has left, in this order.
+var phaseOrder = []partition.Phase{
+	partition.PhaseDiscovered,
+	partition.PhaseLocated,
+	partition.PhaseFormatted,
+	partition.PhaseEncrypted,
+	partition.PhaseMounted,
+	partition.PhaseProvisioned,
+}
+
+// Event is emitted on every successful (or failed) phase transition so a higher-level
+// operator can observe progress without polling the disk itself.
+type Event struct {
+	OsdID int
+	From  partition.Phase
+	To    partition.Phase
+	Err   error
+}
+
+// Controller reconciles a partition.Scheme's entries against the phases they still need to
+// complete, persisting progress back to ConfigDir after every phase so a restart resumes
+// rather than repeats completed work.
+type Controller struct {
+	// ConfigDir is where the scheme file (and thus phase progress) is persisted.
+	ConfigDir string
+	// Events, if non-nil, receives a notification for every phase transition attempted.
+	Events chan<- Event
+}
+
+// NewController creates a Controller that persists scheme progress to configDir. events may
+// be nil if the caller doesn't need phase notifications.
+func NewController(configDir string, events chan<- Event) *Controller {
+	return &Controller{ConfigDir: configDir, Events: events}
+}
+
+// Reconcile drives every entry in scheme forward to partition.PhaseProvisioned, one phase at a
+// time, saving the scheme back to c.ConfigDir after each phase transition. It stops at the
+// first entry that fails so the caller can fix the underlying problem and retry; entries
+// already reconciled on a prior call resume from their persisted Phase instead of restarting.
+func (c *Controller) Reconcile(ctx context.Context, scheme *partition.Scheme) error {
+	for _, entry := range scheme.Entries {
+		if err := c.advance(ctx, scheme, entry); err != nil {
+			return fmt.Errorf("failed to reconcile osd %d: %+v", entry.ID, err)
+		}
+	}
+	return nil
+}
+
+type phaseStep struct {
+	phase partition.Phase
+	run   func(ctx context.Context, entry *partition.PerfSchemeEntry) error
+}
+
+func (c *Controller) advance(ctx context.Context, scheme *partition.Scheme, entry *partition.PerfSchemeEntry) error {
+	current := c.currentPhase(entry)
+
+	steps := []phaseStep{
+		{partition.PhaseLocated, c.locate},
+		{partition.PhaseFormatted, c.format},
+		{partition.PhaseEncrypted, c.encrypt},
+		{partition.PhaseMounted, c.mount},
+		{partition.PhaseProvisioned, c.provision},
+	}
+
+	for _, step := range steps {
+		if !isBefore(current, step.phase) {
+			// already completed on a prior Reconcile call
+			continue
+		}
+
+		if err := step.run(ctx, entry); err != nil {
+			c.emit(Event{OsdID: entry.ID, From: current, To: step.phase, Err: err})
+			return err
+		}
+
+		from := current
+		current = step.phase
+		entry.Phase = current
+		if err := scheme.Save(c.ConfigDir); err != nil {
+			return fmt.Errorf("failed to persist phase %s for osd %d: %+v", current, entry.ID, err)
+		}
+		c.emit(Event{OsdID: entry.ID, From: from, To: current})
+	}
+
+	return nil
+}
+
+// currentPhase returns the phase entry should be treated as having already reached, discounting
+// any persisted progress past PhaseLocated whose kernel state does not survive a reboot even
+// though the scheme file does: the tmpfs data directory set up by format, and everything built on
+// top of it in the same boot (the LUKS mapping, the block symlink, ceph-osd's prepare). Only the
+// partitions themselves, found via udev in locate, are guaranteed to still be there.
+func (c *Controller) currentPhase(entry *partition.PerfSchemeEntry) partition.Phase {
+	current := entry.Phase
+	if current == "" {
+		current = partition.PhaseDiscovered
+	}
+
+	if isBefore(current, partition.PhaseFormatted) {
+		return current
+	}
+
+	if mounted, err := isMountPoint(MountPath(entry.ID)); err != nil || !mounted {
+		return partition.PhaseLocated
+	}
+
+	return current
+}
+
+func (c *Controller) emit(event Event) {
+	if c.Events == nil {
+		return
+	}
+	c.Events <- event
+}
+
+// locate resolves the device node backing every one of entry's partitions by PartitionUUID,
+// waiting (bounded) for udev to create the /dev/disk/by-partuuid symlink if sgdisk only just
+// ran. It is idempotent: once every partition resolves, calling it again is a cheap no-op.
+func (c *Controller) locate(ctx context.Context, entry *partition.PerfSchemeEntry) error {
+	for name, p := range entry.Partitions {
+		if _, err := WaitFor(ctx, p.PartitionUUID, DefaultLocateTimeout); err != nil {
+			return fmt.Errorf("failed to locate %s partition: %+v", name, err)
+		}
+	}
+	return nil
+}
+
+// format sets up the OSD's data directory at MountPath(entry.ID): a tmpfs mount that will hold a
+// "block" symlink to the real device (added by mount, once any encryption is in place). Bluestore's
+// wal/db/block partitions are consumed raw by Ceph and are never formatted with a filesystem
+// themselves, encrypted or not, so there is nothing to mkfs here.
+func (c *Controller) format(ctx context.Context, entry *partition.PerfSchemeEntry) error {
+	if _, ok := entry.Partitions[partition.BlockPartitionName]; !ok {
+		return nil
+	}
+
+	target := MountPath(entry.ID)
+	if _, err := runCommand(MkdirCmd, "-p", target); err != nil {
+		return fmt.Errorf("failed to create osd data directory %s: %+v", target, err)
+	}
+
+	if _, err := runCommand(MountCmd, "-t", "tmpfs", "tmpfs", target); err != nil {
+		return fmt.Errorf("failed to mount tmpfs osd data directory at %s: %+v", target, err)
+	}
+	return nil
+}
+
+// encrypt wraps the OSD's block partition in LUKS2 when the scheme was populated with a
+// BluestoreConfig.Encryption, leaving it open at luks.MapperPath(entry.ID) for mount to consume.
+// It is a no-op for plaintext OSDs. If entry.LuksUUID already resolves to a device (the header
+// was written on a previous boot, rather than being created here for the first time), the
+// existing container is reopened instead of reformatted, since reformatting it would destroy the
+// OSD's data.
+func (c *Controller) encrypt(ctx context.Context, entry *partition.PerfSchemeEntry) error {
+	if entry.LuksUUID == "" {
+		return nil
+	}
+
+	p, ok := entry.Partitions[partition.BlockPartitionName]
+	if !ok {
+		return nil
+	}
+
+	keyFile := KeyFilePath(entry.ID)
+
+	if device, err := luksResolveByUUID(entry.LuksUUID); err == nil {
+		if _, err := luksOpen(device, entry.ID, keyFile); err != nil {
+			return err
+		}
+		logger.Infof("osd %d's existing LUKS2 header %s reopened", entry.ID, entry.LuksUUID)
+		return nil
+	}
+
+	device, err := WaitFor(ctx, p.PartitionUUID, DefaultLocateTimeout)
+	if err != nil {
+		return err
+	}
+
+	if err := luksFormat(device, entry.LuksUUID, *entry.Encryption, keyFile); err != nil {
+		return err
+	}
+	if _, err := luksOpen(device, entry.ID, keyFile); err != nil {
+		return err
+	}
+
+	logger.Infof("osd %d partitions are LUKS2-encrypted under header %s", entry.ID, entry.LuksUUID)
+	return nil
+}
+
+// mount links the OSD's block device into its tmpfs data directory (set up by format) as
+// MountPath(entry.ID)/block: the raw partition device for a plaintext OSD, or the /dev/mapper
+// device opened by encrypt for an encrypted one. ceph-osd reads straight through this symlink;
+// bluestore's block partition is never itself mounted or formatted with a filesystem.
+func (c *Controller) mount(ctx context.Context, entry *partition.PerfSchemeEntry) error {
+	p, ok := entry.Partitions[partition.BlockPartitionName]
+	if !ok {
+		return nil
+	}
+
+	var device string
+	if entry.LuksUUID != "" {
+		device = luks.MapperPath(entry.ID)
+	} else {
+		resolved, err := WaitFor(ctx, p.PartitionUUID, DefaultLocateTimeout)
+		if err != nil {
+			return err
+		}
+		device = resolved
+	}
+
+	link := filepath.Join(MountPath(entry.ID), "block")
+	if _, err := runCommand(LnCmd, "-sfn", device, link); err != nil {
+		return fmt.Errorf("failed to link %s to %s: %+v", link, device, err)
+	}
+	return nil
+}
+
+// KeyFilePath is the well-known location of the passphrase/keyfile used to unlock an
+// encrypted OSD's LUKS2 container, keyed by OSD ID.
+func KeyFilePath(osdID int) string {
+	return fmt.Sprintf("/var/lib/rook/osd%d.key", osdID)
+}
+
+// provision hands the mounted, formatted, (optionally) encrypted OSD off to Ceph to prepare.
+func (c *Controller) provision(ctx context.Context, entry *partition.PerfSchemeEntry) error {
+	target := MountPath(entry.ID)
+	if _, err := runCommand(CephOsdCmd, "--mkfs", "--osd-data", target, "--osd-uuid", entry.OsdUUID.String()); err != nil {
+		return fmt.Errorf("failed to prepare osd %d: %+v", entry.ID, err)
+	}
+	return nil
+}
+
+// MountPath is the well-known path an OSD's data directory is mounted at.
+func MountPath(osdID int) string {
+	return fmt.Sprintf("/var/lib/rook/osd%d", osdID)
+}
+
+// isBefore reports whether phase comes strictly before target in the fixed phase ordering.
+func isBefore(phase, target partition.Phase) bool {
+	return phaseIndex(phase) < phaseIndex(target)
+}
+
+func phaseIndex(phase partition.Phase) int {
+	for i, p := range phaseOrder {
+		if p == phase {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rook/rook/pkg/cephmgr/osd/partition"
+	"github.com/rook/rook/pkg/cephmgr/osd/partition/luks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcileAdvancesEntryThroughAllPhases(t *testing.T) {
+	defer resetRunCommand()
+	defer resetStatPath()
+	statPath = func(name string) (os.FileInfo, error) { return nil, nil }
+	runCommand = func(name string, args ...string) ([]byte, error) { return nil, nil }
+
+	configDir, err := ioutil.TempDir("", "TestReconcileAdvancesEntryThroughAllPhases")
+	assert.Nil(t, err)
+	defer os.RemoveAll(configDir)
+
+	entry := partition.NewPerfSchemeEntry()
+	entry.ID = 1
+	entry.OsdUUID = uuid.Must(uuid.NewRandom())
+	entry.Partitions[partition.BlockPartitionName] = &partition.PerfSchemePartitionDetails{
+		Device: "sdb", PartitionUUID: uuid.Must(uuid.NewRandom()).String(), SizeMB: -1, OffsetMB: 1,
+	}
+	scheme := &partition.Scheme{Entries: []*partition.PerfSchemeEntry{entry}}
+
+	events := make(chan Event, 16)
+	controller := NewController(configDir, events)
+	err = controller.Reconcile(context.Background(), scheme)
+	assert.Nil(t, err)
+	assert.Equal(t, partition.PhaseProvisioned, entry.Phase)
+	close(events)
+
+	var transitions []partition.Phase
+	for event := range events {
+		assert.Nil(t, event.Err)
+		transitions = append(transitions, event.To)
+	}
+	assert.Equal(t, []partition.Phase{
+		partition.PhaseLocated, partition.PhaseFormatted, partition.PhaseEncrypted,
+		partition.PhaseMounted, partition.PhaseProvisioned,
+	}, transitions)
+
+	// the phase must have been persisted, so loading the scheme back shows the same progress
+	loaded, err := partition.LoadScheme(configDir)
+	assert.Nil(t, err)
+	assert.Equal(t, partition.PhaseProvisioned, loaded.Entries[0].Phase)
+}
+
+func TestReconcileResumesFromPersistedPhase(t *testing.T) {
+	defer resetRunCommand()
+	defer resetStatPath()
+	defer resetIsMountPoint()
+	statPath = func(name string) (os.FileInfo, error) { return nil, nil }
+	isMountPoint = func(target string) (bool, error) { return true, nil }
+
+	var ran [][]string
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		ran = append(ran, append([]string{name}, args...))
+		return nil, nil
+	}
+
+	configDir, err := ioutil.TempDir("", "TestReconcileResumesFromPersistedPhase")
+	assert.Nil(t, err)
+	defer os.RemoveAll(configDir)
+
+	entry := partition.NewPerfSchemeEntry()
+	entry.ID = 2
+	entry.Phase = partition.PhaseMounted
+	entry.Partitions[partition.BlockPartitionName] = &partition.PerfSchemePartitionDetails{
+		Device: "sdc", PartitionUUID: uuid.Must(uuid.NewRandom()).String(), SizeMB: -1, OffsetMB: 1,
+	}
+	scheme := &partition.Scheme{Entries: []*partition.PerfSchemeEntry{entry}}
+
+	controller := NewController(configDir, nil)
+	err = controller.Reconcile(context.Background(), scheme)
+	assert.Nil(t, err)
+	assert.Equal(t, partition.PhaseProvisioned, entry.Phase)
+
+	// only the remaining provision phase should have run a command
+	assert.Equal(t, 1, len(ran))
+	assert.Equal(t, CephOsdCmd, ran[0][0])
+}
+
+func TestReconcileStopsOnFailure(t *testing.T) {
+	defer resetRunCommand()
+	defer resetStatPath()
+	statPath = func(name string) (os.FileInfo, error) { return nil, os.ErrNotExist }
+	pollInterval = 0
+
+	configDir, err := ioutil.TempDir("", "TestReconcileStopsOnFailure")
+	assert.Nil(t, err)
+	defer os.RemoveAll(configDir)
+
+	entry := partition.NewPerfSchemeEntry()
+	entry.ID = 3
+	entry.Partitions[partition.BlockPartitionName] = &partition.PerfSchemePartitionDetails{
+		Device: "sdd", PartitionUUID: uuid.Must(uuid.NewRandom()).String(), SizeMB: -1, OffsetMB: 1,
+	}
+	scheme := &partition.Scheme{Entries: []*partition.PerfSchemeEntry{entry}}
+
+	events := make(chan Event, 16)
+	controller := NewController(configDir, events)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = controller.Reconcile(ctx, scheme)
+	assert.NotNil(t, err)
+	assert.Equal(t, partition.Phase(""), entry.Phase)
+}
+
+func TestReconcileFormatsAndOpensLuksForEncryptedEntry(t *testing.T) {
+	defer resetRunCommand()
+	defer resetStatPath()
+	defer resetLuks()
+	statPath = func(name string) (os.FileInfo, error) { return nil, nil }
+	luksResolveByUUID = func(luksUUID string) (string, error) {
+		return "", fmt.Errorf("no header found, this is a first-time provision")
+	}
+
+	var ran [][]string
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		ran = append(ran, append([]string{name}, args...))
+		return nil, nil
+	}
+
+	var formatted, opened bool
+	luksFormat = func(device, luksUUID string, config partition.EncryptionConfig, keyFile string) error {
+		formatted = true
+		assert.Equal(t, "luks2", config.Type)
+		assert.Equal(t, KeyFilePath(4), keyFile)
+		return nil
+	}
+	luksOpen = func(device string, osdID int, keyFile string) (string, error) {
+		opened = true
+		return luks.MapperPath(osdID), nil
+	}
+
+	configDir, err := ioutil.TempDir("", "TestReconcileFormatsAndOpensLuksForEncryptedEntry")
+	assert.Nil(t, err)
+	defer os.RemoveAll(configDir)
+
+	entry := partition.NewPerfSchemeEntry()
+	entry.ID = 4
+	entry.OsdUUID = uuid.Must(uuid.NewRandom())
+	entry.LuksUUID = uuid.Must(uuid.NewRandom()).String()
+	entry.Encryption = &partition.EncryptionConfig{Type: "luks2", KeySize: 512, PBKDF: "argon2id", Cipher: "aes-xts-plain64", KeySource: "file"}
+	entry.Partitions[partition.BlockPartitionName] = &partition.PerfSchemePartitionDetails{
+		Device: "sde", PartitionUUID: uuid.Must(uuid.NewRandom()).String(), SizeMB: -1, OffsetMB: 1,
+	}
+	scheme := &partition.Scheme{Entries: []*partition.PerfSchemeEntry{entry}}
+
+	controller := NewController(configDir, nil)
+	err = controller.Reconcile(context.Background(), scheme)
+	assert.Nil(t, err)
+	assert.Equal(t, partition.PhaseProvisioned, entry.Phase)
+	assert.True(t, formatted)
+	assert.True(t, opened)
+
+	// mount must have linked in the LUKS mapper device, not the raw partition
+	var linkRan []string
+	for _, args := range ran {
+		if args[0] == LnCmd {
+			linkRan = args
+		}
+	}
+	assert.Equal(t, []string{LnCmd, "-sfn", luks.MapperPath(4), filepath.Join(MountPath(4), "block")}, linkRan)
+}
+
+func TestReconcileReopensLuksWithoutReformattingWhenHeaderAlreadyExists(t *testing.T) {
+	defer resetRunCommand()
+	defer resetStatPath()
+	defer resetLuks()
+	statPath = func(name string) (os.FileInfo, error) { return nil, nil }
+
+	runCommand = func(name string, args ...string) ([]byte, error) { return nil, nil }
+
+	var formatted, opened bool
+	luksResolveByUUID = func(luksUUID string) (string, error) {
+		return "/dev/sdf1", nil
+	}
+	luksFormat = func(device, luksUUID string, config partition.EncryptionConfig, keyFile string) error {
+		formatted = true
+		return nil
+	}
+	luksOpen = func(device string, osdID int, keyFile string) (string, error) {
+		opened = true
+		assert.Equal(t, "/dev/sdf1", device)
+		return luks.MapperPath(osdID), nil
+	}
+
+	configDir, err := ioutil.TempDir("", "TestReconcileReopensLuksWithoutReformattingWhenHeaderAlreadyExists")
+	assert.Nil(t, err)
+	defer os.RemoveAll(configDir)
+
+	entry := partition.NewPerfSchemeEntry()
+	entry.ID = 5
+	entry.OsdUUID = uuid.Must(uuid.NewRandom())
+	entry.LuksUUID = uuid.Must(uuid.NewRandom()).String()
+	entry.Encryption = &partition.EncryptionConfig{Type: "luks2", KeySize: 512, PBKDF: "argon2id", Cipher: "aes-xts-plain64", KeySource: "file"}
+	entry.Partitions[partition.BlockPartitionName] = &partition.PerfSchemePartitionDetails{
+		Device: "sdf", PartitionUUID: uuid.Must(uuid.NewRandom()).String(), SizeMB: -1, OffsetMB: 1,
+	}
+	scheme := &partition.Scheme{Entries: []*partition.PerfSchemeEntry{entry}}
+
+	controller := NewController(configDir, nil)
+	err = controller.Reconcile(context.Background(), scheme)
+	assert.Nil(t, err)
+	assert.Equal(t, partition.PhaseProvisioned, entry.Phase)
+	assert.False(t, formatted)
+	assert.True(t, opened)
+}
+
+func TestReconcileRedoesKernelStateAfterReboot(t *testing.T) {
+	defer resetRunCommand()
+	defer resetStatPath()
+	defer resetIsMountPoint()
+	statPath = func(name string) (os.FileInfo, error) { return nil, nil }
+	isMountPoint = func(target string) (bool, error) { return false, nil }
+
+	var ran [][]string
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		ran = append(ran, append([]string{name}, args...))
+		return nil, nil
+	}
+
+	configDir, err := ioutil.TempDir("", "TestReconcileRedoesKernelStateAfterReboot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(configDir)
+
+	entry := partition.NewPerfSchemeEntry()
+	entry.ID = 6
+	// the scheme file says this entry finished provisioning on a prior boot, but nothing on
+	// this boot's filesystem backs that up: format's tmpfs mount is gone.
+	entry.Phase = partition.PhaseProvisioned
+	entry.Partitions[partition.BlockPartitionName] = &partition.PerfSchemePartitionDetails{
+		Device: "sdg", PartitionUUID: uuid.Must(uuid.NewRandom()).String(), SizeMB: -1, OffsetMB: 1,
+	}
+	scheme := &partition.Scheme{Entries: []*partition.PerfSchemeEntry{entry}}
+
+	events := make(chan Event, 16)
+	controller := NewController(configDir, events)
+	err = controller.Reconcile(context.Background(), scheme)
+	assert.Nil(t, err)
+	assert.Equal(t, partition.PhaseProvisioned, entry.Phase)
+	close(events)
+
+	var transitions []partition.Phase
+	for event := range events {
+		assert.Nil(t, event.Err)
+		transitions = append(transitions, event.To)
+	}
+	// locate is skipped (the partition device node itself is assumed to have survived via
+	// udev), but format/encrypt/mount/provision must all redo their work.
+	assert.Equal(t, []partition.Phase{
+		partition.PhaseFormatted, partition.PhaseEncrypted, partition.PhaseMounted, partition.PhaseProvisioned,
+	}, transitions)
+	assert.True(t, len(ran) > 0)
+}
+
+func resetLuks() {
+	luksFormat = luks.Format
+	luksOpen = luks.Open
+	luksResolveByUUID = luks.ResolveByUUID
+}
+
+func resetRunCommand() {
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		return nil, nil
+	}
+}
+
+func resetStatPath() {
+	statPath = os.Lstat
+	pollInterval = 200 * time.Millisecond
+}
+
+func resetIsMountPoint() {
+	isMountPoint = isMountPointFromProcMounts
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultLocateTimeout bounds how long WaitFor will poll for a partition to appear before
+// giving up.
+const DefaultLocateTimeout = 30 * time.Second
+
+// pollInterval is how often WaitFor re-checks for the partition. A var so tests can shrink it.
+var pollInterval = 200 * time.Millisecond
+
+// statPath is indirected so tests can simulate udev creating the symlink partway through.
+var statPath = os.Lstat
+
+// WaitFor blocks until the given GPT/MBR PARTUUID appears under /dev/disk/by-partuuid, sgdisk
+// having just triggered a kernel re-read of the partition table, or returns an error once ctx
+// is done or timeout elapses. Locating partitions this way avoids racing udev and avoids the
+// instability of raw "sdX" device names, which can be reassigned across reboots.
+func WaitFor(ctx context.Context, partUUID string, timeout time.Duration) (string, error) {
+	path := byPartUUIDPath(partUUID)
+	deadline := time.Now().Add(timeout)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		if _, err := statPath(path); err == nil {
+			return path, nil
+		}
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out after %s waiting for partition %s to appear at %s", timeout, partUUID, path)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+func byPartUUIDPath(partUUID string) string {
+	return fmt.Sprintf("/dev/disk/by-partuuid/%s", strings.ToLower(partUUID))
+}
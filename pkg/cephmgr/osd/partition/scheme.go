@@ -0,0 +1,491 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package partition computes and persists the on-disk partition layout
+// (the "scheme") that Rook uses to lay out bluestore OSDs across one or
+// more raw block devices.
+package partition
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/google/uuid"
+)
+
+var logger = capnslog.NewPackageLogger("github.com/rook/rook", "partition")
+
+const (
+	// WalPartitionName is the name given to the bluestore write-ahead-log partition.
+	WalPartitionName = "wal"
+	// DatabasePartitionName is the name given to the bluestore metadata database partition.
+	DatabasePartitionName = "db"
+	// BlockPartitionName is the name given to the bluestore primary data partition.
+	BlockPartitionName = "block"
+
+	schemeFileName = "scheme.json"
+
+	// sectorsPerMB is the number of 512 byte sectors in a megabyte, the unit sgdisk expects.
+	sectorsPerMB = 2048
+)
+
+// BluestoreConfig captures the desired sizes of the bluestore wal/db partitions. The
+// block partition always consumes whatever space remains on its device.
+type BluestoreConfig struct {
+	WalSizeMB      int64
+	DatabaseSizeMB int64
+
+	// Encryption, when set, causes the block partition to be wrapped in a LUKS2 container
+	// and pads the wal/db partition sizes by the LUKS2 header size. The wal/db partitions
+	// themselves are not encrypted. Leave nil for a plaintext OSD.
+	Encryption *EncryptionConfig
+}
+
+// EncryptionConfig describes how an OSD's partitions should be encrypted at rest.
+type EncryptionConfig struct {
+	// Type is the encryption format, currently only "luks2" is supported.
+	Type string
+	// KeySize is the LUKS master key size in bits, e.g. 512.
+	KeySize int
+	// PBKDF is the key derivation function, e.g. "argon2id".
+	PBKDF string
+	// Cipher is the LUKS cipher spec, e.g. "aes-xts-plain64".
+	Cipher string
+	// KeySource is where the passphrase/keyfile used to unlock the container comes from:
+	// "file", "kms", or "tpm2". luks.Format accepts only "file" and returns an error for
+	// "kms" and "tpm2".
+	KeySource string
+}
+
+// luks2HeaderSizeMB is the space reserved at the front of an encrypted partition for the
+// LUKS2 header and keyslot area, enough for cryptsetup's default luksFormat layout.
+const luks2HeaderSizeMB = 16
+
+// PerfSchemePartitionDetails describes where a single partition of an OSD lives.
+type PerfSchemePartitionDetails struct {
+	Device        string
+	DiskUUID      string
+	PartitionUUID string
+	SizeMB        int64
+	OffsetMB      int64
+
+	// Bootable marks the partition with the MBR active/boot flag. Ignored by the GPT backend.
+	Bootable bool
+	// PartType is the partition type: a GPT type GUID for the sgdisk backend, or for the
+	// DOS backend the partition type passed to parted's mkpart ("primary", "logical" or
+	// "extended"); the DOS backend does not set an MBR type code. Left empty to accept the
+	// backend's default.
+	PartType string
+
+	// Disposition controls whether GetPartitionArgs creates, skips, or merely validates
+	// this partition against what ClassifyEntry found already on disk. The zero value
+	// behaves like DispositionForce, i.e. today's "always create" behavior.
+	Disposition Disposition
+	// ExistingNumber is the partition number ClassifyEntry found this PartitionUUID
+	// already occupying on disk. Only meaningful when Disposition is DispositionPreserve.
+	ExistingNumber int
+	// Expand, when the partition is DispositionPreserve and its SizeMB is -1, causes
+	// GetPartitionArgs to resize it in place to once again consume the rest of the disk,
+	// instead of leaving its on-disk size untouched.
+	Expand bool
+}
+
+// Disposition classifies how GetPartitionArgs should treat a partition that may already
+// exist on disk from a previous Apply.
+type Disposition string
+
+const (
+	// DispositionForce always creates the partition, destroying whatever PARTUUID
+	// previously occupied that slot. The zero value ("") is treated the same way.
+	DispositionForce Disposition = "Force"
+	// DispositionSkip leaves the partition on disk completely untouched: no args are
+	// emitted for it at all.
+	DispositionSkip Disposition = "Skip"
+	// DispositionPreserve means the partition was found on disk with a matching PARTUUID;
+	// unless Expand is also set, the GPT backend emits a read-only --info clause for it and
+	// the DOS backend emits nothing.
+	DispositionPreserve Disposition = "Preserve"
+)
+
+// PerfSchemeEntry describes the full set of partitions (wal/db/block) backing one OSD.
+type PerfSchemeEntry struct {
+	ID         int
+	OsdUUID    uuid.UUID
+	Partitions map[string]*PerfSchemePartitionDetails
+
+	// LuksUUID is the stable LUKS2 header UUID for this OSD's encrypted block partition, set
+	// only when the entry was populated with a BluestoreConfig.Encryption. It is used to
+	// reopen the encrypted device on reboot, since the LUKS header UUID differs from the
+	// GPT PartitionUUID.
+	LuksUUID string
+
+	// Encryption is the config the entry was populated with, carried along so later
+	// consumers (provisioner.Controller) know how to luksFormat/luksOpen this OSD's
+	// partitions. Set only alongside LuksUUID, for an encrypted OSD.
+	Encryption *EncryptionConfig
+
+	// TableType selects the partition table backend used by GetPartitionArgs: "gpt" (the
+	// default, via sgdisk) or "dos" (via parted, for MBR disks). Leave empty for "gpt".
+	TableType string
+
+	// Phase records how far provisioner.Controller has gotten in bringing this OSD's
+	// partitions online, so a restart can resume instead of redoing completed work. An
+	// empty value is equivalent to PhaseDiscovered.
+	Phase Phase
+}
+
+// NewPerfSchemeEntry creates an empty entry ready to be populated.
+func NewPerfSchemeEntry() *PerfSchemeEntry {
+	return &PerfSchemeEntry{Partitions: map[string]*PerfSchemePartitionDetails{}}
+}
+
+// Phase is a step in bringing up an OSD's partitions, tracked by provisioner.Controller.
+type Phase string
+
+const (
+	// PhaseDiscovered is the starting phase: the entry exists in the scheme but nothing
+	// has been done with it yet.
+	PhaseDiscovered Phase = "Discovered"
+	// PhaseLocated means every partition's device node has been found on disk.
+	PhaseLocated Phase = "Located"
+	// PhaseFormatted means the OSD's tmpfs data directory has been created and mounted at its
+	// well-known path. No partition is given a filesystem.
+	PhaseFormatted Phase = "Formatted"
+	// PhaseEncrypted means any LUKS-wrapped partition has been formatted/opened.
+	PhaseEncrypted Phase = "Encrypted"
+	// PhaseMounted means the OSD's block device (the raw partition or its LUKS mapper device)
+	// has been linked into its data directory as "block".
+	PhaseMounted Phase = "Mounted"
+	// PhaseProvisioned means the OSD has been handed off to `ceph-osd --mkfs` (prepare).
+	PhaseProvisioned Phase = "Provisioned"
+)
+
+// MetadataDevicePartition describes a single wal or db partition living on a shared metadata device.
+type MetadataDevicePartition struct {
+	ID            int
+	OsdUUID       uuid.UUID
+	Name          string
+	PartitionUUID string
+	SizeMB        int64
+	OffsetMB      int64
+
+	// Bootable marks the partition with the MBR active/boot flag. Ignored by the GPT backend.
+	Bootable bool
+	// PartType is the partition type: a GPT type GUID for the sgdisk backend, or for the
+	// DOS backend the partition type passed to parted's mkpart ("primary", "logical" or
+	// "extended"); the DOS backend does not set an MBR type code. Left empty to accept the
+	// backend's default.
+	PartType string
+
+	// Disposition controls whether GetPartitionArgs creates, skips, or merely validates
+	// this partition against what ClassifyMetadata found already on disk. The zero value
+	// behaves like DispositionForce, i.e. today's "always create" behavior.
+	Disposition Disposition
+	// ExistingNumber is the partition number ClassifyMetadata found this PartitionUUID
+	// already occupying on disk. Only meaningful when Disposition is DispositionPreserve.
+	ExistingNumber int
+	// Expand, when the partition is DispositionPreserve and its SizeMB is -1, causes
+	// GetPartitionArgs to resize it in place to once again consume the rest of the disk,
+	// instead of leaving its on-disk size untouched.
+	Expand bool
+}
+
+// MetadataDeviceInfo describes a device shared by multiple OSDs to hold their wal/db partitions.
+type MetadataDeviceInfo struct {
+	Device     string
+	DiskUUID   string
+	Partitions []*MetadataDevicePartition
+
+	// TableType selects the partition table backend used by GetPartitionArgs: "gpt" (the
+	// default, via sgdisk) or "dos" (via parted, for MBR disks). Leave empty for "gpt".
+	TableType string
+}
+
+// NewMetadataDeviceInfo creates metadata device info for the given device name (e.g. "sda").
+func NewMetadataDeviceInfo(device string) *MetadataDeviceInfo {
+	return &MetadataDeviceInfo{Device: device}
+}
+
+// Scheme is the full, persisted partition layout for all OSDs on a node.
+type Scheme struct {
+	Metadata *MetadataDeviceInfo
+	Entries  []*PerfSchemeEntry
+}
+
+// LoadScheme loads the persisted scheme from the given config directory. If no scheme has
+// been saved yet, an empty scheme is returned with no error.
+func LoadScheme(configDir string) (*Scheme, error) {
+	scheme := &Scheme{Entries: []*PerfSchemeEntry{}}
+
+	path := filepath.Join(configDir, schemeFileName)
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return scheme, nil
+		}
+		return nil, fmt.Errorf("failed to read scheme file %s: %+v", path, err)
+	}
+
+	if err := json.Unmarshal(contents, scheme); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal scheme file %s: %+v", path, err)
+	}
+
+	return scheme, nil
+}
+
+// Save persists the scheme to the given config directory.
+func (s *Scheme) Save(configDir string) error {
+	contents, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scheme: %+v", err)
+	}
+
+	path := filepath.Join(configDir, schemeFileName)
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		return fmt.Errorf("failed to write scheme file %s: %+v", path, err)
+	}
+
+	return nil
+}
+
+// PopulateCollocatedPerfSchemeEntry lays out the wal, db and block partitions for a single
+// OSD all on the one given device, in that order, with block consuming the remaining space.
+func PopulateCollocatedPerfSchemeEntry(entry *PerfSchemeEntry, device string, bluestoreConfig BluestoreConfig) error {
+	offset := int64(1)
+	walSize := encryptedSizeMB(bluestoreConfig, bluestoreConfig.WalSizeMB)
+	dbSize := encryptedSizeMB(bluestoreConfig, bluestoreConfig.DatabaseSizeMB)
+
+	entry.Partitions[WalPartitionName] = &PerfSchemePartitionDetails{
+		Device:        device,
+		PartitionUUID: newUUID(),
+		OffsetMB:      offset,
+		SizeMB:        walSize,
+	}
+	offset += walSize
+
+	entry.Partitions[DatabasePartitionName] = &PerfSchemePartitionDetails{
+		Device:        device,
+		PartitionUUID: newUUID(),
+		OffsetMB:      offset,
+		SizeMB:        dbSize,
+	}
+	offset += dbSize
+
+	entry.Partitions[BlockPartitionName] = &PerfSchemePartitionDetails{
+		Device:        device,
+		DiskUUID:      newUUID(),
+		PartitionUUID: newUUID(),
+		OffsetMB:      offset,
+		SizeMB:        -1,
+	}
+
+	if bluestoreConfig.Encryption != nil {
+		entry.LuksUUID = newUUID()
+		entry.Encryption = bluestoreConfig.Encryption
+	}
+
+	return nil
+}
+
+// encryptedSizeMB returns the partition size needed to hold requestedMB of usable bluestore
+// space, padding for the LUKS2 header when the config calls for encryption.
+func encryptedSizeMB(bluestoreConfig BluestoreConfig, requestedMB int64) int64 {
+	if bluestoreConfig.Encryption == nil || requestedMB < 0 {
+		return requestedMB
+	}
+	return requestedMB + luks2HeaderSizeMB
+}
+
+// PopulateDistributedPerfSchemeEntry lays out the wal and db partitions for a single OSD on
+// the shared metadata device, appending after any partitions already claimed by other OSDs,
+// while the block partition gets its own dedicated device.
+func PopulateDistributedPerfSchemeEntry(entry *PerfSchemeEntry, device string, metadata *MetadataDeviceInfo,
+	bluestoreConfig BluestoreConfig) error {
+
+	offset := int64(1)
+	if len(metadata.Partitions) > 0 {
+		last := metadata.Partitions[len(metadata.Partitions)-1]
+		offset = last.OffsetMB + last.SizeMB
+	}
+	walSize := encryptedSizeMB(bluestoreConfig, bluestoreConfig.WalSizeMB)
+	dbSize := encryptedSizeMB(bluestoreConfig, bluestoreConfig.DatabaseSizeMB)
+
+	walUUID := newUUID()
+	metadata.Partitions = append(metadata.Partitions, &MetadataDevicePartition{
+		ID:            entry.ID,
+		OsdUUID:       entry.OsdUUID,
+		Name:          WalPartitionName,
+		PartitionUUID: walUUID,
+		OffsetMB:      offset,
+		SizeMB:        walSize,
+	})
+	entry.Partitions[WalPartitionName] = &PerfSchemePartitionDetails{
+		Device:        metadata.Device,
+		PartitionUUID: walUUID,
+		OffsetMB:      offset,
+		SizeMB:        walSize,
+	}
+	offset += walSize
+
+	dbUUID := newUUID()
+	metadata.Partitions = append(metadata.Partitions, &MetadataDevicePartition{
+		ID:            entry.ID,
+		OsdUUID:       entry.OsdUUID,
+		Name:          DatabasePartitionName,
+		PartitionUUID: dbUUID,
+		OffsetMB:      offset,
+		SizeMB:        dbSize,
+	})
+	entry.Partitions[DatabasePartitionName] = &PerfSchemePartitionDetails{
+		Device:        metadata.Device,
+		PartitionUUID: dbUUID,
+		OffsetMB:      offset,
+		SizeMB:        dbSize,
+	}
+
+	entry.Partitions[BlockPartitionName] = &PerfSchemePartitionDetails{
+		Device:        device,
+		DiskUUID:      newUUID(),
+		PartitionUUID: newUUID(),
+		OffsetMB:      1,
+		SizeMB:        -1,
+	}
+
+	if bluestoreConfig.Encryption != nil {
+		entry.LuksUUID = newUUID()
+		entry.Encryption = bluestoreConfig.Encryption
+	}
+
+	return nil
+}
+
+// GetPartitionArgs returns the partition table backend's arguments needed to create the
+// wal/db/block partitions for this OSD on its device(s). The backend is chosen by e.TableType
+// ("gpt", the default, or "dos").
+func (e *PerfSchemeEntry) GetPartitionArgs() []string {
+	var partitions []*PerfSchemePartitionDetails
+	var names []string
+	var device, diskGUID string
+
+	for _, name := range []string{WalPartitionName, DatabasePartitionName, BlockPartitionName} {
+		p, ok := e.Partitions[name]
+		if !ok {
+			continue
+		}
+
+		device = p.Device
+		if p.DiskUUID != "" {
+			diskGUID = p.DiskUUID
+		}
+
+		partitions = append(partitions, p)
+		names = append(names, name)
+	}
+
+	dispositions := make([]Disposition, len(partitions))
+	existingNumbers := make([]int, len(partitions))
+	for i, p := range partitions {
+		dispositions[i] = p.Disposition
+		existingNumbers[i] = p.ExistingNumber
+	}
+	numbers := assignPartitionNumbers(dispositions, existingNumbers)
+
+	specs := make([]PartitionSpec, len(partitions))
+	for i, p := range partitions {
+		specs[i] = PartitionSpec{
+			Number:        numbers[i],
+			OffsetMB:      p.OffsetMB,
+			SizeMB:        p.SizeMB,
+			Name:          fmt.Sprintf("ROOK-OSD%d-%s", e.ID, strings.ToUpper(names[i])),
+			PartitionUUID: p.PartitionUUID,
+			PartType:      p.PartType,
+			Bootable:      p.Bootable,
+			Disposition:   p.Disposition,
+			Expand:        p.Expand,
+		}
+	}
+
+	return backendFor(e.TableType).Create(specs, diskGUID, device)
+}
+
+// GetPartitionArgs returns the partition table backend's arguments needed to create every
+// wal/db partition that has been laid out on this shared metadata device. The backend is
+// chosen by m.TableType ("gpt", the default, or "dos").
+func (m *MetadataDeviceInfo) GetPartitionArgs() []string {
+	dispositions := make([]Disposition, len(m.Partitions))
+	existingNumbers := make([]int, len(m.Partitions))
+	for i, p := range m.Partitions {
+		dispositions[i] = p.Disposition
+		existingNumbers[i] = p.ExistingNumber
+	}
+	numbers := assignPartitionNumbers(dispositions, existingNumbers)
+
+	specs := make([]PartitionSpec, len(m.Partitions))
+	for i, p := range m.Partitions {
+		specs[i] = PartitionSpec{
+			Number:        numbers[i],
+			OffsetMB:      p.OffsetMB,
+			SizeMB:        p.SizeMB,
+			Name:          fmt.Sprintf("ROOK-OSD%d-%s", p.ID, strings.ToUpper(p.Name)),
+			PartitionUUID: p.PartitionUUID,
+			PartType:      p.PartType,
+			Bootable:      p.Bootable,
+			Disposition:   p.Disposition,
+			Expand:        p.Expand,
+		}
+	}
+
+	return backendFor(m.TableType).Create(specs, m.DiskUUID, m.Device)
+}
+
+// assignPartitionNumbers picks the sgdisk/parted partition number for each partition in
+// order: a DispositionPreserve partition with a known ExistingNumber keeps that number, while
+// every other partition gets the next number not already claimed by a preserved partition.
+func assignPartitionNumbers(dispositions []Disposition, existingNumbers []int) []int {
+	used := map[int]bool{}
+	for i, d := range dispositions {
+		if d == DispositionPreserve && existingNumbers[i] > 0 {
+			used[existingNumbers[i]] = true
+		}
+	}
+
+	numbers := make([]int, len(dispositions))
+	next := 1
+	for i, d := range dispositions {
+		if d == DispositionPreserve && existingNumbers[i] > 0 {
+			numbers[i] = existingNumbers[i]
+			continue
+		}
+
+		for used[next] {
+			next++
+		}
+		numbers[i] = next
+		used[next] = true
+		next++
+	}
+
+	return numbers
+}
+
+func newUUID() string {
+	return uuid.Must(uuid.NewRandom()).String()
+}
@@ -85,6 +85,21 @@ func TestPopulateCollocatedPerfSchemeEntry(t *testing.T) {
 
 }
 
+func TestPopulateCollocatedPerfSchemeEntryEncrypted(t *testing.T) {
+	entry := NewPerfSchemeEntry()
+	entry.ID = 11
+	entry.OsdUUID = uuid.Must(uuid.NewRandom())
+	bluestoreConfig := BluestoreConfig{WalSizeMB: 1, DatabaseSizeMB: 2, Encryption: &EncryptionConfig{Type: "luks2"}}
+	err := PopulateCollocatedPerfSchemeEntry(entry, "sda", bluestoreConfig)
+	assert.Nil(t, err)
+
+	// wal/db partitions should be padded with the LUKS2 header, block still takes the rest
+	assert.NotEqual(t, "", entry.LuksUUID)
+	verifyPartitionDetails(t, entry, WalPartitionName, "sda", 1, 1+luks2HeaderSizeMB)
+	verifyPartitionDetails(t, entry, DatabasePartitionName, "sda", 1+luks2HeaderSizeMB+1, 2+luks2HeaderSizeMB)
+	verifyPartitionDetails(t, entry, BlockPartitionName, "sda", 1+2*luks2HeaderSizeMB+3, -1)
+}
+
 func TestPopulateDistributedPerfSchemeEntry(t *testing.T) {
 	metadata := NewMetadataDeviceInfo("sda")
 
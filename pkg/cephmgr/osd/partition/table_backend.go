@@ -0,0 +1,191 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partition
+
+import "fmt"
+
+// PartitionSpec describes a single partition to be created on a device, independent of
+// whichever PartitionTableBackend ends up realizing it.
+type PartitionSpec struct {
+	// Number is the 1-based partition number.
+	Number int
+	// OffsetMB is the partition's start offset, in MB from the start of the disk.
+	OffsetMB int64
+	// SizeMB is the partition's size in MB, or -1 to consume the rest of the disk.
+	SizeMB int64
+	// Name is a human readable label to attach to the partition (GPT partition name).
+	Name string
+	// PartitionUUID is the unique id to assign the partition. Only the GPT backend assigns
+	// it; the DOS backend does not set it.
+	PartitionUUID string
+	// PartType is a backend-specific partition type: a GPT type GUID, or the partition
+	// type passed to parted's mkpart ("primary", "logical" or "extended"); the DOS backend
+	// does not set an MBR type code. Empty accepts the backend's default.
+	PartType string
+	// Bootable marks the MBR active/boot flag. Ignored by the GPT backend.
+	Bootable bool
+	// Disposition says whether this partition should be created, left alone, or merely
+	// validated/expanded against what is already on disk. The zero value behaves like
+	// DispositionForce, today's "always create" behavior.
+	Disposition Disposition
+	// Expand resizes a DispositionPreserve partition back out to SizeMB == -1 in place,
+	// without touching any other partition's table entry.
+	Expand bool
+}
+
+// PartitionTableBackend creates and wipes partition tables on a device. Rook ships a GPT
+// backend (sgdisk) and a DOS/MBR backend (parted); both are driven by the same PartitionSpec
+// so the rest of the partition package stays backend-agnostic.
+type PartitionTableBackend interface {
+	// ExecutablePath is the name of the command line tool this backend shells out to.
+	ExecutablePath() string
+	// Create returns the command line arguments that lay out specs on device. The GPT
+	// backend also assigns it the given disk-level UUID; the DOS backend ignores diskGUID.
+	Create(specs []PartitionSpec, diskGUID, device string) []string
+	// Wipe returns the command line arguments that clear any existing partition table
+	// from device.
+	Wipe(device string) []string
+}
+
+// backendFor resolves the partition table backend for the given entry/metadata device
+// TableType value. An empty/unrecognized value defaults to "gpt".
+func backendFor(tableType string) PartitionTableBackend {
+	switch tableType {
+	case "dos":
+		return dosBackend{}
+	default:
+		return gptBackend{}
+	}
+}
+
+// gptBackend lays out GPT partition tables with sgdisk.
+type gptBackend struct{}
+
+func (gptBackend) ExecutablePath() string {
+	return "sgdisk"
+}
+
+func (gptBackend) Create(specs []PartitionSpec, diskGUID, device string) []string {
+	args := []string{}
+
+	for _, s := range specs {
+		switch s.Disposition {
+		case DispositionSkip:
+			continue
+
+		case DispositionPreserve:
+			if !s.Expand || s.SizeMB != -1 {
+				// read-only: confirm the partition is there without touching it
+				args = append(args, fmt.Sprintf("--info=%d", s.Number))
+				continue
+			}
+			// resize this partition's table entry back out to fill the disk, without
+			// touching any earlier partition's entry
+			args = append(args, fmt.Sprintf("--delete=%d", s.Number))
+			args = append(args, fmt.Sprintf("--largest-new=%d", s.Number))
+			args = append(args, fmt.Sprintf("--change-name=%d:%s", s.Number, s.Name))
+			args = append(args, fmt.Sprintf("--partition-guid=%d:%s", s.Number, s.PartitionUUID))
+			if s.PartType != "" {
+				args = append(args, fmt.Sprintf("--typecode=%d:%s", s.Number, s.PartType))
+			}
+
+		default: // DispositionForce, or the zero value
+			if s.SizeMB == -1 {
+				args = append(args, fmt.Sprintf("--largest-new=%d", s.Number))
+			} else {
+				args = append(args, fmt.Sprintf("--new=%d:%d:+%d", s.Number, s.OffsetMB*sectorsPerMB, s.SizeMB*sectorsPerMB))
+			}
+			args = append(args, fmt.Sprintf("--change-name=%d:%s", s.Number, s.Name))
+			args = append(args, fmt.Sprintf("--partition-guid=%d:%s", s.Number, s.PartitionUUID))
+			if s.PartType != "" {
+				args = append(args, fmt.Sprintf("--typecode=%d:%s", s.Number, s.PartType))
+			}
+		}
+	}
+
+	args = append(args, fmt.Sprintf("--disk-guid=%s", diskGUID))
+	args = append(args, fmt.Sprintf("/dev/%s", device))
+	return args
+}
+
+func (gptBackend) Wipe(device string) []string {
+	return []string{"--zap-all", fmt.Sprintf("/dev/%s", device)}
+}
+
+// dosBackend lays out MBR (DOS) partition tables with parted, which accepts a full layout
+// as plain command line arguments instead of requiring an interactive/stdin script.
+type dosBackend struct{}
+
+func (dosBackend) ExecutablePath() string {
+	return "parted"
+}
+
+func (dosBackend) Create(specs []PartitionSpec, diskGUID, device string) []string {
+	args := []string{"-s", "-a", "optimal", fmt.Sprintf("/dev/%s", device), "--"}
+	if !hasPreservedPartition(specs) {
+		// a greenfield layout: lay down a fresh msdos table before adding partitions. A
+		// re-apply that is preserving/skipping any existing partition must not do this, or
+		// it would wipe out the very table those partitions live in.
+		args = append(args, "mklabel", "msdos")
+	}
+
+	for _, s := range specs {
+		if s.Disposition == DispositionSkip || (s.Disposition == DispositionPreserve && (!s.Expand || s.SizeMB != -1)) {
+			// left alone entirely, or merely confirmed to exist
+			continue
+		}
+
+		if s.Disposition == DispositionPreserve {
+			// grow the existing partition out to the end of the disk in place, rather than
+			// creating a new partition over it
+			args = append(args, "resizepart", fmt.Sprintf("%d", s.Number), "100%")
+			continue
+		}
+
+		partType := s.PartType
+		if partType == "" {
+			partType = "primary"
+		}
+
+		end := "100%"
+		if s.SizeMB != -1 {
+			end = fmt.Sprintf("%dMiB", s.OffsetMB+s.SizeMB)
+		}
+
+		args = append(args, "mkpart", partType, fmt.Sprintf("%dMiB", s.OffsetMB), end)
+		if s.Bootable {
+			args = append(args, "set", fmt.Sprintf("%d", s.Number), "boot", "on")
+		}
+	}
+
+	return args
+}
+
+// hasPreservedPartition reports whether any spec already exists on disk (Preserve or Skip),
+// meaning the table itself must not be re-created from scratch.
+func hasPreservedPartition(specs []PartitionSpec) bool {
+	for _, s := range specs {
+		if s.Disposition == DispositionPreserve || s.Disposition == DispositionSkip {
+			return true
+		}
+	}
+	return false
+}
+
+func (dosBackend) Wipe(device string) []string {
+	return []string{"-s", fmt.Sprintf("/dev/%s", device), "mklabel", "msdos"}
+}
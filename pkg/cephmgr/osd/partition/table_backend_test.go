@@ -0,0 +1,101 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partition
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemeEntryGetPartitionArgsGptBackendEmitsTypecode(t *testing.T) {
+	e1 := NewPerfSchemeEntry()
+	e1.ID = 1
+	e1.OsdUUID = uuid.Must(uuid.NewRandom())
+
+	bluestoreConfig := BluestoreConfig{WalSizeMB: 1, DatabaseSizeMB: 2}
+	err := PopulateCollocatedPerfSchemeEntry(e1, "sdb", bluestoreConfig)
+	assert.Nil(t, err)
+	e1.Partitions[BlockPartitionName].PartType = "4fbd7e29-9d25-41b8-afd0-062c0ceff05d"
+
+	expectedArgs := []string{
+		"--new=1:2048:+2048", "--change-name=1:ROOK-OSD1-WAL", fmt.Sprintf("--partition-guid=1:%s", e1.Partitions[WalPartitionName].PartitionUUID),
+		"--new=2:4096:+4096", "--change-name=2:ROOK-OSD1-DB", fmt.Sprintf("--partition-guid=2:%s", e1.Partitions[DatabasePartitionName].PartitionUUID),
+		"--largest-new=3", "--change-name=3:ROOK-OSD1-BLOCK", fmt.Sprintf("--partition-guid=3:%s", e1.Partitions[BlockPartitionName].PartitionUUID),
+		"--typecode=3:4fbd7e29-9d25-41b8-afd0-062c0ceff05d",
+		fmt.Sprintf("--disk-guid=%s", e1.Partitions[BlockPartitionName].DiskUUID), "/dev/sdb",
+	}
+
+	args := e1.GetPartitionArgs()
+	assert.Equal(t, expectedArgs, args)
+}
+
+func TestSchemeEntryGetPartitionArgsDosBackend(t *testing.T) {
+	e1 := NewPerfSchemeEntry()
+	e1.ID = 1
+	e1.OsdUUID = uuid.Must(uuid.NewRandom())
+	e1.TableType = "dos"
+
+	bluestoreConfig := BluestoreConfig{WalSizeMB: 1, DatabaseSizeMB: 2}
+	err := PopulateCollocatedPerfSchemeEntry(e1, "sdb", bluestoreConfig)
+	assert.Nil(t, err)
+	e1.Partitions[BlockPartitionName].Bootable = true
+
+	expectedArgs := []string{
+		"-s", "-a", "optimal", "/dev/sdb", "--", "mklabel", "msdos",
+		"mkpart", "primary", "1MiB", "2MiB",
+		"mkpart", "primary", "2MiB", "4MiB",
+		"mkpart", "primary", "4MiB", "100%",
+		"set", "3", "boot", "on",
+	}
+
+	args := e1.GetPartitionArgs()
+	assert.Equal(t, expectedArgs, args)
+}
+
+func TestSchemeEntryGetPartitionArgsDosBackendPreservesExistingTable(t *testing.T) {
+	e1 := NewPerfSchemeEntry()
+	e1.ID = 1
+	e1.OsdUUID = uuid.Must(uuid.NewRandom())
+	e1.TableType = "dos"
+
+	bluestoreConfig := BluestoreConfig{WalSizeMB: 1, DatabaseSizeMB: 2}
+	err := PopulateCollocatedPerfSchemeEntry(e1, "sdb", bluestoreConfig)
+	assert.Nil(t, err)
+
+	existing := map[string]int{
+		e1.Partitions[WalPartitionName].PartitionUUID:      1,
+		e1.Partitions[DatabasePartitionName].PartitionUUID: 2,
+		e1.Partitions[BlockPartitionName].PartitionUUID:    3,
+	}
+	ClassifyEntry(e1, existing)
+
+	expectedArgs := []string{
+		"-s", "-a", "optimal", "/dev/sdb", "--",
+	}
+
+	args := e1.GetPartitionArgs()
+	assert.Equal(t, expectedArgs, args)
+}
+
+func TestBackendForDefaultsToGpt(t *testing.T) {
+	assert.Equal(t, gptBackend{}, backendFor(""))
+	assert.Equal(t, gptBackend{}, backendFor("gpt"))
+	assert.Equal(t, dosBackend{}, backendFor("dos"))
+}